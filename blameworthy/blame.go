@@ -0,0 +1,175 @@
+package blameworthy
+
+import "fmt"
+
+// LineBlame identifies the commit that most recently introduced or
+// modified a single line of a file.
+type LineBlame struct {
+	Hash   string
+	Author string
+	Date   int32
+}
+
+type blameCacheKey struct {
+	path     string
+	revision string // always a resolved commit hash, never a ref
+}
+
+// Blame returns, for every line of path as it existed at revision, the
+// commit that last introduced or modified that line — the same
+// question `git blame` answers, computed from the diffs already
+// parsed into h.Files instead of re-invoking git.
+func (h *GitHistory) Blame(path string, revision string) ([]LineBlame, error) {
+	return h.BlameRange(path, revision, 0, 0)
+}
+
+// BlameRange is Blame restricted to the 1-indexed, inclusive line
+// range [startLine, endLine]; passing 0, 0 blames the whole file. It
+// computes and caches blame for the whole file and returns only the
+// requested lines, so a caller paging through a file in a UI pays for
+// the computation once per (path, commit) rather than once per page.
+func (h *GitHistory) BlameRange(path string, revision string, startLine int, endLine int) ([]LineBlame, error) {
+	full, err := h.fullBlame(path, revision)
+	if err != nil {
+		return nil, err
+	}
+	if startLine == 0 && endLine == 0 {
+		return full, nil
+	}
+	if startLine < 1 {
+		startLine = 1
+	}
+	if endLine > len(full) {
+		endLine = len(full)
+	}
+	if startLine > endLine {
+		return nil, nil
+	}
+	return full[startLine-1 : endLine], nil
+}
+
+// fullBlame computes (or returns the cached) blame of path as of
+// revision, caching the result keyed by (path, the resolved commit).
+func (h *GitHistory) fullBlame(path string, revision string) ([]LineBlame, error) {
+	commit := h.LookupCommit(revision)
+	if commit == nil {
+		return nil, fmt.Errorf("blameworthy: unknown revision %q", revision)
+	}
+	key := blameCacheKey{path, commit.Hash}
+
+	h.blameMu.Lock()
+	if cached, ok := h.blameCache[key]; ok {
+		h.blameMu.Unlock()
+		return cached, nil
+	}
+	h.blameMu.Unlock()
+
+	targetPos := h.hashPosition(commit.Hash)
+
+	var origin []*Commit
+	for _, diff := range selectMergeDiffs(h.Files[path]) {
+		if pos := h.hashPosition(diff.Commit.Hash); pos >= 0 && pos > targetPos {
+			break
+		}
+		applyDiff(&origin, diff)
+	}
+
+	blame := make([]LineBlame, len(origin))
+	for i, c := range origin {
+		if c == nil {
+			continue
+		}
+		blame[i] = LineBlame{Hash: c.Hash, Author: c.Author, Date: c.Date}
+	}
+
+	h.blameMu.Lock()
+	if h.blameCache == nil {
+		h.blameCache = map[blameCacheKey][]LineBlame{}
+	}
+	h.blameCache[key] = blame
+	h.blameMu.Unlock()
+
+	return blame, nil
+}
+
+// hashPosition returns hash's index into h.Hashes, or -1 if hash isn't
+// one of h's known commits.
+func (h *GitHistory) hashPosition(hash string) int {
+	h.blameMu.Lock()
+	defer h.blameMu.Unlock()
+	if h.hashPos == nil {
+		h.hashPos = make(map[string]int, len(h.Hashes))
+		for i, hh := range h.Hashes {
+			h.hashPos[hh] = i
+		}
+	}
+	if pos, ok := h.hashPos[hash]; ok {
+		return pos
+	}
+	return -1
+}
+
+// selectMergeDiffs collapses the several diffs a merge commit parsed
+// with RunGitLogOpts.FollowAllParents may record for one path (one per
+// parent it differs from) down to a single diff per commit: the one
+// with the fewest hunks. That approximates git's own blame behavior of
+// attributing a merged-in line to the parent that actually introduced
+// it rather than to the merge commit itself, since the side of the
+// merge that needed the least patching up is the one the final content
+// most closely followed.
+func selectMergeDiffs(diffs File) File {
+	indexOf := map[*Commit]int{}
+	var result File
+	for _, d := range diffs {
+		if i, ok := indexOf[d.Commit]; ok {
+			if len(d.Hunks) < len(result[i].Hunks) {
+				result[i] = d
+			}
+			continue
+		}
+		indexOf[d.Commit] = len(result)
+		result = append(result, d)
+	}
+	return result
+}
+
+// applyDiff updates origin, the commit that last touched each of a
+// file's current lines, to reflect one more diff against that file.
+// Hunks are applied in reverse order so that an earlier hunk's line
+// numbers, which are given relative to the file before any of this
+// diff's hunks were applied, stay valid.
+func applyDiff(origin *[]*Commit, diff Diff) {
+	lines := *origin
+	for i := len(diff.Hunks) - 1; i >= 0; i-- {
+		hunk := diff.Hunks[i]
+
+		var start int
+		switch {
+		case hunk.OldStart == 0:
+			start = 0 // OldStart of 0 means a pure insertion at the top of the file
+		case hunk.OldLength == 0:
+			start = hunk.OldStart // a pure insertion goes after OldStart, not at it
+		default:
+			start = hunk.OldStart - 1
+		}
+		oldLength := hunk.OldLength
+		if start+oldLength > len(lines) {
+			oldLength = len(lines) - start
+		}
+		if oldLength < 0 {
+			oldLength = 0
+		}
+
+		added := make([]*Commit, hunk.NewLength)
+		for j := range added {
+			added[j] = diff.Commit
+		}
+
+		spliced := make([]*Commit, 0, len(lines)-oldLength+len(added))
+		spliced = append(spliced, lines[:start]...)
+		spliced = append(spliced, added...)
+		spliced = append(spliced, lines[start+oldLength:]...)
+		lines = spliced
+	}
+	*origin = lines
+}
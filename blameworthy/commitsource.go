@@ -0,0 +1,417 @@
+package blameworthy
+
+// This file's use of iter.Seq (range-over-func, Go 1.23) and of
+// github.com/go-git/go-git/v5 raises the module's minimum Go version
+// and adds a dependency beyond what the rest of this package needs;
+// go.mod's `go` directive and require block need bumping accordingly
+// when this lands in a module that has one.
+
+import (
+	"context"
+	"iter"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// RawCommit is the synthetic record a CommitSource emits for one
+// commit: enough to build a GitHistory from without re-invoking `git
+// log` or ever touching a repository's working tree.
+type RawCommit struct {
+	Hash    string
+	Parents []string
+	Author  string
+	Date    int32
+	Diffs   []RawDiff
+}
+
+// RawDiff is one file's change within a RawCommit, matching the Diff
+// fields ParseGitLog itself fills in.
+type RawDiff struct {
+	Path           string
+	ChecksumBefore string
+	ChecksumAfter  string
+	Hunks          []Hunk
+	RenamedFrom    string
+	Parent         string
+}
+
+// CommitSource produces a repository's commits, oldest first, as
+// RawCommit records. It exists so a GitHistory can be built from
+// something other than a forked `git log` process.
+type CommitSource interface {
+	// Commits iterates a repository's commits. Implementations must
+	// stop promptly once ctx is done. Errors encountered mid-walk
+	// simply end the sequence early; there is no side channel to
+	// report them, so callers that need to distinguish "no more
+	// commits" from "the walk failed" should check ctx.Err() (or,
+	// for ExecCommitSource, rerun RunGitLog/ParseGitLog directly).
+	Commits(ctx context.Context) iter.Seq[*RawCommit]
+}
+
+// BuildHistory constructs a GitHistory by draining source, start to
+// finish. It performs the same rename-chain stitching and hash-width
+// detection ParseGitLog does, so a history built from ExecCommitSource
+// matches one built directly with ParseGitLog. One built from
+// GoGitCommitSource differs in two ways, inherited from how that
+// source produces RawCommits: it does no rename detection of its own
+// (see GoGitCommitSource's doc comment), and without
+// RunGitLogOpts.FollowAllParents it still emits every commit reachable
+// from its Revision, including those reachable only through a merge's
+// later parents, rather than only the first-parent chain RunGitLog
+// walks.
+func BuildHistory(ctx context.Context, source CommitSource) (*GitHistory, error) {
+	history := &GitHistory{
+		Commits: make(map[string]*Commit),
+		Files:   make(map[string]File),
+	}
+
+	for raw := range source.Commits(ctx) {
+		if history.HashLength == 0 && len(raw.Hash) > 0 {
+			// ExecCommitSource's hashes are already truncated, so a
+			// SHA-256 one may arrive SHA256HashLength wide.
+			if len(raw.Hash) == 64 || len(raw.Hash) == SHA256HashLength {
+				history.HashAlgorithm = SHA256
+				history.HashLength = SHA256HashLength
+			} else {
+				history.HashAlgorithm = SHA1
+				history.HashLength = HashLength
+			}
+		}
+		hash := raw.Hash
+		if history.HashLength > 0 && len(hash) > history.HashLength {
+			hash = hash[:history.HashLength]
+		}
+
+		commit := &Commit{
+			Hash:    hash,
+			Author:  raw.Author,
+			Date:    raw.Date,
+			Parents: truncateHashes(raw.Parents, history.HashLength),
+		}
+		history.Hashes = append(history.Hashes, hash)
+		history.Commits[hash] = commit
+
+		for _, rd := range raw.Diffs {
+			diffs := history.Files[rd.Path]
+			if rd.RenamedFrom != "" {
+				diffs = append(File{}, history.Files[rd.RenamedFrom]...)
+			}
+			diffs = append(diffs, Diff{
+				Commit:         commit,
+				Path:           rd.Path,
+				ChecksumBefore: rd.ChecksumBefore,
+				ChecksumAfter:  rd.ChecksumAfter,
+				Hunks:          rd.Hunks,
+				RenamedFrom:    rd.RenamedFrom,
+				Parent:         truncateHashes([]string{rd.Parent}, history.HashLength)[0],
+			})
+			history.Files[rd.Path] = diffs
+			commit.Diffs = append(commit.Diffs, &diffs[len(diffs)-1])
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return history, err
+	}
+	return history, nil
+}
+
+func truncateHashes(hashes []string, length int) []string {
+	if length == 0 {
+		return hashes
+	}
+	out := make([]string, len(hashes))
+	for i, h := range hashes {
+		if len(h) > length {
+			h = h[:length]
+		}
+		out[i] = h
+	}
+	return out
+}
+
+// ExecCommitSource is the CommitSource backed by shelling out to the
+// `git` binary, via RunGitLog and ParseGitLog. It is what livegrep has
+// always used.
+type ExecCommitSource struct {
+	RepositoryPath string
+	Revision       string
+	Opts           RunGitLogOpts
+}
+
+func (s ExecCommitSource) Commits(ctx context.Context) iter.Seq[*RawCommit] {
+	return func(yield func(*RawCommit) bool) {
+		stdout, err := RunGitLog(ctx, s.RepositoryPath, s.Revision, s.Opts)
+		if err != nil {
+			return
+		}
+		history, err := ParseGitLog(stdout)
+		if err != nil {
+			return
+		}
+		for _, hash := range history.Hashes {
+			if ctx.Err() != nil {
+				return
+			}
+			if !yield(rawCommitOf(history.Commits[hash])) {
+				return
+			}
+		}
+	}
+}
+
+func rawCommitOf(commit *Commit) *RawCommit {
+	raw := &RawCommit{
+		Hash:    commit.Hash,
+		Parents: commit.Parents,
+		Author:  commit.Author,
+		Date:    commit.Date,
+	}
+	for _, d := range commit.Diffs {
+		raw.Diffs = append(raw.Diffs, RawDiff{
+			Path:           d.Path,
+			ChecksumBefore: d.ChecksumBefore,
+			ChecksumAfter:  d.ChecksumAfter,
+			Hunks:          d.Hunks,
+			RenamedFrom:    d.RenamedFrom,
+			Parent:         d.Parent,
+		})
+	}
+	return raw
+}
+
+// GoGitCommitSource is the CommitSource backed by
+// github.com/go-git/go-git/v5, walking a repository's object database
+// directly instead of forking a `git` process. It lets embedders index
+// bare repositories without a `git` binary on PATH, and its walk stops
+// as soon as ctx is cancelled instead of running to completion behind
+// an unkillable pipe.
+//
+// Unlike ExecCommitSource, it does not yet run rename detection (the
+// object database walk git's --find-renames does isn't replicated
+// here), so a renamed file is reported as a delete and an add rather
+// than a single RawDiff with RenamedFrom set.
+type GoGitCommitSource struct {
+	RepositoryPath string
+	Revision       string // a ref or commit hash go-git understands; "" means HEAD
+	Opts           RunGitLogOpts
+}
+
+func (s GoGitCommitSource) Commits(ctx context.Context) iter.Seq[*RawCommit] {
+	return func(yield func(*RawCommit) bool) {
+		repo, err := git.PlainOpen(s.RepositoryPath)
+		if err != nil {
+			return
+		}
+
+		from, err := s.resolveFrom(repo)
+		if err != nil {
+			return
+		}
+
+		commitIter, err := repo.Log(&git.LogOptions{From: from})
+		if err != nil {
+			return
+		}
+
+		// repo.Log walks newest first; collect then replay in
+		// reverse so commits are emitted oldest first, like
+		// RunGitLog's --reverse.
+		var ordered []*object.Commit
+		commitIter.ForEach(func(c *object.Commit) error {
+			if ctx.Err() != nil {
+				return context.Canceled
+			}
+			ordered = append(ordered, c)
+			return nil
+		})
+
+		for i := len(ordered) - 1; i >= 0; i-- {
+			if ctx.Err() != nil {
+				return
+			}
+			raw, err := s.toRawCommit(ordered[i])
+			if err != nil {
+				continue
+			}
+			if !yield(raw) {
+				return
+			}
+		}
+	}
+}
+
+func (s GoGitCommitSource) resolveFrom(repo *git.Repository) (plumbing.Hash, error) {
+	if s.Revision == "" {
+		head, err := repo.Head()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return head.Hash(), nil
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(s.Revision))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return *hash, nil
+}
+
+func (s GoGitCommitSource) toRawCommit(c *object.Commit) (*RawCommit, error) {
+	raw := &RawCommit{
+		Hash:   c.Hash.String(),
+		Author: c.Author.Email,
+		Date:   dateToYYYYMMDD(c.Committer.When),
+	}
+
+	parents := make([]*object.Commit, 0, c.NumParents())
+	err := c.Parents().ForEach(func(p *object.Commit) error {
+		raw.Parents = append(raw.Parents, p.Hash.String())
+		parents = append(parents, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !s.Opts.FollowAllParents && len(parents) > 1 {
+		// Collapse a merge to a diff against its first parent only,
+		// matching --first-parent -m.
+		parents = parents[:1]
+	}
+
+	if len(parents) == 0 {
+		tree, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+		changes, err := object.DiffTree(nil, tree)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := changes.Patch()
+		if err != nil {
+			return nil, err
+		}
+		raw.Diffs = append(raw.Diffs, rawDiffsOf(patch, "")...)
+		return raw, nil
+	}
+
+	for _, p := range parents {
+		patch, err := p.Patch(c)
+		if err != nil {
+			return nil, err
+		}
+		parent := ""
+		if c.NumParents() > 1 {
+			parent = p.Hash.String()
+		}
+		raw.Diffs = append(raw.Diffs, rawDiffsOf(patch, parent)...)
+	}
+	return raw, nil
+}
+
+// dateToYYYYMMDD matches the "--date=format:%Y%m%d" RunGitLog asks
+// `git log` for, so a Commit.Date compares the same way regardless of
+// which CommitSource produced it.
+func dateToYYYYMMDD(t time.Time) int32 {
+	return int32(t.Year())*10000 + int32(t.Month())*100 + int32(t.Day())
+}
+
+func rawDiffsOf(patch *object.Patch, parent string) []RawDiff {
+	var diffs []RawDiff
+	for _, fp := range patch.FilePatches() {
+		from, to := fp.Files()
+		path := ""
+		checksumBefore, checksumAfter := "", ""
+		if from != nil {
+			path = from.Path()
+			checksumBefore = from.Hash().String()
+		}
+		if to != nil {
+			path = to.Path()
+			checksumAfter = to.Hash().String()
+		}
+		renamedFrom := ""
+		if from != nil && to != nil && from.Path() != to.Path() {
+			renamedFrom = from.Path()
+		}
+		diffs = append(diffs, RawDiff{
+			Path:           path,
+			ChecksumBefore: checksumBefore,
+			ChecksumAfter:  checksumAfter,
+			Hunks:          hunksOf(fp),
+			RenamedFrom:    renamedFrom,
+			Parent:         parent,
+		})
+	}
+	return diffs
+}
+
+// hunksOf turns go-git's equal/delete/add chunk sequence for one file
+// into the same Hunk{OldStart,OldLength,NewStart,NewLength} shape
+// ParseGitLog extracts from `git log`'s unified diff headers.
+func hunksOf(fp diff.FilePatch) []Hunk {
+	var hunks []Hunk
+	oldLine, newLine := 1, 1
+	pendingDelete := false
+	var pendingOldStart, pendingOldLength int
+
+	flushDelete := func(newLength int) {
+		if pendingDelete {
+			// Like OldStart for a pure insertion, a pure deletion's
+			// NewStart is the line before where the deleted lines were.
+			newStart := newLine
+			if newLength == 0 {
+				newStart = newLine - 1
+			}
+			hunks = append(hunks, Hunk{
+				OldStart: pendingOldStart, OldLength: pendingOldLength,
+				NewStart: newStart, NewLength: newLength,
+			})
+			pendingDelete = false
+		}
+	}
+
+	for _, chunk := range fp.Chunks() {
+		lines := lineCount(chunk.Content())
+		switch chunk.Type() {
+		case diff.Equal:
+			flushDelete(0)
+			oldLine += lines
+			newLine += lines
+		case diff.Delete:
+			flushDelete(0)
+			pendingDelete = true
+			pendingOldStart, pendingOldLength = oldLine, lines
+			oldLine += lines
+		case diff.Add:
+			if pendingDelete {
+				flushDelete(lines)
+			} else {
+				// A pure insertion's OldStart is the line *before*
+				// the inserted lines (0 for one at the top of the
+				// file), matching `git log`'s own hunk headers and
+				// the OldLength == 0 case applyDiff expects.
+				hunks = append(hunks, Hunk{OldStart: oldLine - 1, OldLength: 0, NewStart: newLine, NewLength: lines})
+			}
+			newLine += lines
+		}
+	}
+	flushDelete(0)
+	return hunks
+}
+
+func lineCount(content string) int {
+	if content == "" {
+		return 0
+	}
+	n := strings.Count(content, "\n")
+	if !strings.HasSuffix(content, "\n") {
+		n++
+	}
+	return n
+}
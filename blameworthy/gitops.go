@@ -2,20 +2,88 @@ package blameworthy
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-const HashLength = 16 // number of hash characters to preserve
+// Number of hex characters of a commit hash to preserve. SHA-1
+// repositories truncate to HashLength; SHA-256 ones, whose full hashes
+// are 64 hex characters rather than 40, truncate to SHA256HashLength.
+const (
+	HashLength       = 16
+	SHA256HashLength = 32
+)
+
+// ObjectFormat identifies the hash algorithm a repository's git
+// objects (and therefore its commit hashes) are addressed by.
+type ObjectFormat string
+
+const (
+	SHA1   ObjectFormat = "sha1"
+	SHA256 ObjectFormat = "sha256"
+)
+
+// DetectObjectFormat reports the object format that repository_path's
+// git objects are addressed by.
+func DetectObjectFormat(repository_path string) (ObjectFormat, error) {
+	out, err := exec.Command("git",
+		"-C", repository_path,
+		"rev-parse", "--show-object-format",
+	).Output()
+	if err != nil {
+		return "", err
+	}
+	return ObjectFormat(strings.TrimSpace(string(out))), nil
+}
 
 type GitHistory struct {
 	Hashes  []string
 	Commits map[string]*Commit
 	Files   map[string]File
+
+	// HashAlgorithm is the object format of the repository this
+	// history was parsed from, detected from the width of the first
+	// commit hash seen.
+	HashAlgorithm ObjectFormat
+
+	// HashLength is the number of hex characters that Hashes,
+	// Commits' keys, and every Commit.Hash, Commit.Parents entry and
+	// Diff.Parent value in this history were truncated to.
+	// Diff.ChecksumBefore and Diff.ChecksumAfter keep full blob hashes.
+	HashLength int
+
+	// blameMu guards hashPos and blameCache, which are built lazily
+	// by Blame/BlameRange (see blame.go).
+	blameMu    sync.Mutex
+	hashPos    map[string]int
+	blameCache map[blameCacheKey][]LineBlame
+}
+
+// LookupCommit finds a commit by hash, tolerating hashes longer or
+// shorter than h.HashLength (for example a full 40- or 64-character
+// hash, or a short abbreviation a user typed) instead of requiring an
+// exact match against the truncated keys h.Commits uses.
+func (h *GitHistory) LookupCommit(hash string) *Commit {
+	if c, ok := h.Commits[hash]; ok {
+		return c
+	}
+	if len(hash) > h.HashLength {
+		if c, ok := h.Commits[hash[:h.HashLength]]; ok {
+			return c
+		}
+	}
+	for key, c := range h.Commits {
+		if strings.HasPrefix(key, hash) {
+			return c
+		}
+	}
+	return nil
 }
 
 type Commit struct {
@@ -23,6 +91,14 @@ type Commit struct {
 	Author string
 	Date   int32 // YYYYMMDD
 	Diffs  []*Diff
+
+	// Parents holds every parent hash of this commit, in the order
+	// `git log` reports them (RunGitLog always asks for a "Merge: "
+	// header, so this is populated the same way regardless of
+	// RunGitLogOpts.FollowAllParents). It is nil for a root commit.
+	// FollowAllParents instead controls whether a merge commit's
+	// Diffs cover every parent or only the first; see Diff.Parent.
+	Parents []string
 }
 
 type File []Diff
@@ -33,6 +109,18 @@ type Diff struct {
 	ChecksumBefore string
 	ChecksumAfter  string
 	Hunks          []Hunk
+
+	// RenamedFrom is the previous path of this file, if this diff is
+	// the commit that renamed it (via "git mv" or an equivalent),
+	// and "" otherwise.
+	RenamedFrom string
+
+	// Parent is the parent hash this diff was computed against, when
+	// its Commit is a merge, and "" for any other commit. A merge parsed
+	// with RunGitLogOpts.FollowAllParents gets one Diff per parent for
+	// each path that differs from that parent; without it, a merge's
+	// Diffs are all against its first parent.
+	Parent string
 }
 
 type Hunk struct {
@@ -42,38 +130,93 @@ type Hunk struct {
 	NewLength int
 }
 
-func RunGitLog(repository_path string, revision string) (io.ReadCloser, error) {
-	cmd := exec.Command("git",
+// DefaultRenameSimilarity is the similarity threshold, as a percentage,
+// used by RunGitLog to detect renames when the caller doesn't specify
+// one. It matches git's own default for -M/--find-renames.
+const DefaultRenameSimilarity = 50
+
+// RunGitLogOpts configures RunGitLog.
+type RunGitLogOpts struct {
+	// RenameSimilarity is the percentage of unchanged lines, 0-100,
+	// above which a deleted file and an added file are reported as a
+	// rename rather than as a separate delete and add. 0 selects
+	// DefaultRenameSimilarity.
+	RenameSimilarity int
+
+	// FollowAllParents, if true, retains every parent of a merge
+	// commit instead of collapsing it to a diff against its first
+	// parent, so that lines brought in from a merged branch can be
+	// attributed to the commit that actually introduced them rather
+	// than to the merge commit. ParseGitLog will record one Diff per
+	// parent for each path that differs from that parent; see
+	// Commit.Parents and Diff.Parent.
+	FollowAllParents bool
+}
+
+// RunGitLog runs `git log` over the given repository and revision range,
+// in a format that ParseGitLog understands. The command is killed if
+// ctx is done before it exits.
+func RunGitLog(ctx context.Context, repository_path string, revision string, opts RunGitLogOpts) (io.ReadCloser, error) {
+	similarity := opts.RenameSimilarity
+	if similarity <= 0 {
+		similarity = DefaultRenameSimilarity
+	}
+
+	args := []string{
 		"-C", repository_path,
 		"log",
 		"-U0",
-		"--format=commit %H%nAuthor: %ae%nDate: %cd",
+		"--format=commit %H%nMerge: %P%nAuthor: %ae%nDate: %cd",
 		"--date=format:%Y%m%d",
 		"--full-index",
 		"--no-prefix",
-		"--no-renames",
+		fmt.Sprintf("--find-renames=%d%%", similarity),
 		"--reverse",
 
 		// Avoid invoking custom diff commands or conversions.
 		"--no-ext-diff",
 		"--no-textconv",
+	}
+	if opts.FollowAllParents {
+		// Split a merge into one diff per parent instead of
+		// discarding every parent but the first.
+		args = append(args, "-m")
+	} else {
+		args = append(args, "--first-parent", "-m")
+	}
+	args = append(args, revision)
 
-		// Treat a merge as a simple diff against its 1st parent:
-		"--first-parent",
-		"-m",
-
-		revision,
-	)
+	cmd := exec.CommandContext(ctx, "git", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
-	//defer cmd.Wait()  // drat, when will we do this?
-	err = cmd.Start()
-	if err != nil {
+	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
-	return stdout, nil
+	// cmd.Wait reaps the process and, per its documentation, closes
+	// stdout once it does -- so it must wait until the caller has
+	// finished reading instead of running right after Start (which is
+	// what the old "drat, when will we do this?" comment here was
+	// stuck on). Tie it to the caller closing the returned pipe.
+	return &waitOnClose{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// waitOnClose reaps the exec.Cmd behind a pipe once the caller closes
+// that pipe, rather than leaking a zombie process for the lifetime of
+// the program.
+type waitOnClose struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (w *waitOnClose) Close() error {
+	closeErr := w.ReadCloser.Close()
+	waitErr := w.cmd.Wait()
+	if closeErr != nil {
+		return closeErr
+	}
+	return waitErr
 }
 
 // Given an input stream from `git log`, print out an abbreviated form
@@ -129,6 +272,8 @@ func StripGitLog(input io.Reader) error {
 }
 
 func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
+	defer input_stream.Close()
+
 	scanner := bufio.NewScanner(input_stream)
 
 	// Give the scanner permission to read very long lines, to
@@ -144,12 +289,30 @@ func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
 	commits := history.Commits
 	files := history.Files
 
+	// hashLength is resolved from the width of the first full commit
+	// hash we see: 40 hex characters means SHA-1, 64 means SHA-256.
+	// It stays 0 (meaning "not yet known") until then.
+	hashLength := 0
+
 	authors := map[string]string{} // dedup authors
 
 	var commit_hash string
 	var checksum string
 	var commit *Commit
 	var diff *Diff
+	var rename_from string     // path named by a pending "rename from" line
+	var diff_from_rename bool  // true while `diff` was created by a rename, not yet confirmed by a "--- " line
+
+	// Tracking for `git log -m` splitting a merge commit into one
+	// diff per parent: merge_parents holds the commit's parent
+	// hashes (empty unless it's a merge), and parent_idx is which
+	// parent the diff section currently being read belongs to. `git
+	// log -m` marks the seam between parents by repeating the whole
+	// "commit <hash>" (and "Merge: ") header once per parent, rather
+	// than by anything in the diffs themselves, so that repeat is
+	// what advances parent_idx below.
+	var merge_parents []string
+	var parent_idx int
 
 	// A dash after the second "@@" is a signal from our command
 	// `strip-git-log` that it has removed the "+" and "-" lines
@@ -157,35 +320,104 @@ func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
 	index_re, _ := regexp.Compile(`^index ([0-9a-f]+)\.\.([0-9a-f]+)`)
 	hunk_re, _ := regexp.Compile(`^@@ -(\d+),?(\d*) \+(\d+),?(\d*) @@(-?)`)
 
+	// currentParent returns the parent hash the Diff about to be
+	// recorded should be attached to, or "" for a non-merge commit.
+	currentParent := func() string {
+		if len(merge_parents) < 2 {
+			return ""
+		}
+		return merge_parents[parent_idx]
+	}
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "commit ") {
-			commit_hash = line[7 : 7+HashLength]
-			history.Hashes = append(history.Hashes, commit_hash)
-			commit = &Commit{commit_hash, "", 0, nil}
-			commits[commit_hash] = commit
+			if hashLength == 0 {
+				switch len(line) - len("commit ") {
+				case 64:
+					history.HashAlgorithm = SHA256
+					hashLength = SHA256HashLength
+				default:
+					history.HashAlgorithm = SHA1
+					hashLength = HashLength
+				}
+				history.HashLength = hashLength
+			}
+			hash := line[7 : 7+hashLength]
+			if commit != nil && hash == commit_hash {
+				// A merge commit's header (and everything down
+				// to its first "diff --git") repeats once per
+				// parent under `git log -m`; this is the same
+				// commit, now diffed against its next parent.
+				if parent_idx+1 < len(merge_parents) {
+					parent_idx++
+				}
+			} else {
+				commit_hash = hash
+				history.Hashes = append(history.Hashes, commit_hash)
+				commit = &Commit{commit_hash, "", 0, nil, nil}
+				commits[commit_hash] = commit
+				merge_parents = nil
+				parent_idx = 0
+			}
+		} else if strings.HasPrefix(line, "Merge: ") {
+			if merge_parents == nil {
+				for _, p := range strings.Fields(line[len("Merge: "):]) {
+					if len(p) > hashLength {
+						p = p[:hashLength]
+					}
+					merge_parents = append(merge_parents, p)
+				}
+				commit.Parents = merge_parents
+			}
+		} else if strings.HasPrefix(line, "diff --git ") {
+			diff_from_rename = false
+			rename_from = ""
+		} else if strings.HasPrefix(line, "rename from ") {
+			rename_from = line[len("rename from "):]
+		} else if strings.HasPrefix(line, "rename to ") {
+			path := line[len("rename to "):]
+			parent := currentParent()
+			checksumBefore := lastChecksum(files, rename_from)
+			files[path] = append(append([]Diff{}, files[rename_from]...), Diff{
+				commit, path,
+				checksumBefore, checksumBefore,
+				[]Hunk{}, rename_from, parent,
+			})
+			diff = &files[path][len(files[path])-1]
+			commit.Diffs = append(commit.Diffs, diff)
+			diff_from_rename = true
 		} else if strings.HasPrefix(line, "index ") {
 			groups := index_re.FindStringSubmatch(line)
 			if groups == nil {
 				continue
 			}
 			checksum = emptyZero(groups[2])
+			if diff_from_rename {
+				diff.ChecksumAfter = checksum
+				checksum = ""
+			}
 		} else if strings.HasPrefix(line, "--- ") {
-			path := line[4:]
 			scanner.Scan() // read the "+++" line
+			if diff_from_rename {
+				// The rename (and any content change alongside
+				// it) was already recorded when we saw "rename
+				// to"; there's no new path to track here.
+				diff_from_rename = false
+				checksum = ""
+				continue
+			}
+			path := line[4:]
 			if path == "/dev/null" {
 				line2 := scanner.Text()
 				path = line2[4:]
 			}
-			checksumBefore := ""
-			if files[path] != nil {
-				i := len(files[path]) - 1
-				checksumBefore = files[path][i].ChecksumAfter
-			}
+			parent := currentParent()
+			checksumBefore := lastChecksum(files, path)
 			files[path] = append(files[path], Diff{
 				commit, path,
 				checksumBefore, checksum,
-				[]Hunk{},
+				[]Hunk{}, "", parent,
 			})
 			checksum = ""
 			diff = &files[path][len(files[path])-1]
@@ -241,3 +473,34 @@ func emptyZero(hash string) string {
 	}
 	return hash
 }
+
+// lastChecksum returns the ChecksumAfter of the most recent diff
+// recorded for path, or "" if path has no history yet.
+func lastChecksum(files map[string]File, path string) string {
+	diffs := files[path]
+	if len(diffs) == 0 {
+		return ""
+	}
+	return diffs[len(diffs)-1].ChecksumAfter
+}
+
+// Followed returns the previous paths, oldest first, that path was
+// known by before being renamed (via "git mv" or an equivalent) to its
+// current name. It does not include path itself, and it returns nil if
+// path has never been renamed.
+func (h *GitHistory) Followed(path string) []string {
+	var prior []string
+	for {
+		renamedFrom := ""
+		for _, d := range h.Files[path] {
+			if d.Path == path && d.RenamedFrom != "" {
+				renamedFrom = d.RenamedFrom
+			}
+		}
+		if renamedFrom == "" {
+			return prior
+		}
+		prior = append([]string{renamedFrom}, prior...)
+		path = renamedFrom
+	}
+}
@@ -0,0 +1,386 @@
+package blameworthy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// historyMagic and historyVersion identify the binary format written by
+// SaveHistory, so LoadHistory can reject files it doesn't understand.
+const historyMagic uint32 = 0x626c6d77 // "blmw"
+const historyVersion uint32 = 4
+
+// SaveHistory writes history to w in a compact binary format: commit
+// and blob hashes as raw bytes rather than hex text, author strings
+// deduplicated by index, and hunks packed as plain int32 tuples. It is
+// meant to be read back with LoadHistory, not inspected by hand.
+//
+// Note that the order of a Commit's Diffs is not preserved across a
+// SaveHistory/LoadHistory round trip; only the order within each File's
+// diff list is.
+func SaveHistory(w io.Writer, history *GitHistory) error {
+	enc := &historyEncoder{w: bufio.NewWriter(w)}
+
+	enc.writeUint32(historyMagic)
+	enc.writeUint32(historyVersion)
+	enc.writeString(string(history.HashAlgorithm))
+	enc.writeUint32(uint32(history.HashLength))
+
+	hashIndex := make(map[string]uint32, len(history.Hashes))
+	for i, hash := range history.Hashes {
+		hashIndex[hash] = uint32(i)
+	}
+
+	authorIndex := map[string]uint32{}
+	var authors []string
+	authorIdx := func(a string) uint32 {
+		if i, ok := authorIndex[a]; ok {
+			return i
+		}
+		i := uint32(len(authors))
+		authorIndex[a] = i
+		authors = append(authors, a)
+		return i
+	}
+	for _, hash := range history.Hashes {
+		authorIdx(history.Commits[hash].Author)
+	}
+
+	enc.writeUint32(uint32(len(authors)))
+	for _, a := range authors {
+		enc.writeString(a)
+	}
+
+	enc.writeUint32(uint32(len(history.Hashes)))
+	for _, hash := range history.Hashes {
+		commit := history.Commits[hash]
+		enc.writeHash(hash)
+		enc.writeUint32(authorIdx(commit.Author))
+		enc.writeUint32(uint32(commit.Date))
+		enc.writeUint32(uint32(len(commit.Parents)))
+		for _, p := range commit.Parents {
+			enc.writeHash(p)
+		}
+	}
+
+	enc.writeUint32(uint32(len(history.Files)))
+	for path, diffs := range history.Files {
+		enc.writeString(path)
+		enc.writeUint32(uint32(len(diffs)))
+		for _, d := range diffs {
+			enc.writeUint32(hashIndex[d.Commit.Hash])
+			enc.writeHash(d.ChecksumBefore)
+			enc.writeHash(d.ChecksumAfter)
+			enc.writeString(d.RenamedFrom)
+			enc.writeHash(d.Parent)
+			enc.writeUint32(uint32(len(d.Hunks)))
+			for _, h := range d.Hunks {
+				enc.writeInt32(int32(h.OldStart))
+				enc.writeInt32(int32(h.OldLength))
+				enc.writeInt32(int32(h.NewStart))
+				enc.writeInt32(int32(h.NewLength))
+			}
+		}
+	}
+
+	if enc.err != nil {
+		return enc.err
+	}
+	return enc.w.Flush()
+}
+
+// LoadHistory reconstructs a GitHistory from data written by
+// SaveHistory.
+func LoadHistory(r io.Reader) (*GitHistory, error) {
+	dec := &historyDecoder{r: bufio.NewReader(r)}
+
+	magic := dec.readUint32()
+	if dec.err != nil {
+		return nil, fmt.Errorf("blameworthy: reading history header: %w", dec.err)
+	}
+	if magic != historyMagic {
+		return nil, fmt.Errorf("blameworthy: not a blameworthy history file")
+	}
+	version := dec.readUint32()
+	if dec.err != nil {
+		return nil, fmt.Errorf("blameworthy: reading history header: %w", dec.err)
+	}
+	if version != historyVersion {
+		return nil, fmt.Errorf("blameworthy: unsupported history format version %d", version)
+	}
+
+	hashAlgorithm := ObjectFormat(dec.readString())
+	hashLength := int(dec.readUint32())
+
+	authorCount := dec.readUint32()
+	authors := make([]string, authorCount)
+	for i := range authors {
+		authors[i] = dec.readString()
+	}
+
+	commitCount := dec.readUint32()
+	history := &GitHistory{
+		Hashes:        make([]string, commitCount),
+		Commits:       make(map[string]*Commit, commitCount),
+		Files:         make(map[string]File),
+		HashAlgorithm: hashAlgorithm,
+		HashLength:    hashLength,
+	}
+	for i := uint32(0); i < commitCount; i++ {
+		hash := dec.readHash()
+		authorIdx := dec.readUint32()
+		date := dec.readUint32()
+		var author string
+		if int(authorIdx) < len(authors) {
+			author = authors[authorIdx]
+		}
+		parentCount := dec.readUint32()
+		var parents []string
+		if parentCount > 0 {
+			parents = make([]string, parentCount)
+			for k := range parents {
+				parents[k] = dec.readHash()
+			}
+		}
+		commit := &Commit{Hash: hash, Author: author, Date: int32(date), Parents: parents}
+		history.Hashes[i] = hash
+		history.Commits[hash] = commit
+	}
+
+	pathCount := dec.readUint32()
+	for i := uint32(0); i < pathCount; i++ {
+		path := dec.readString()
+		diffCount := dec.readUint32()
+		diffs := make(File, diffCount)
+		for j := range diffs {
+			commitIdx := dec.readUint32()
+			var commit *Commit
+			if int(commitIdx) < len(history.Hashes) {
+				commit = history.Commits[history.Hashes[commitIdx]]
+			}
+			checksumBefore := dec.readHash()
+			checksumAfter := dec.readHash()
+			renamedFrom := dec.readString()
+			parent := dec.readHash()
+			hunkCount := dec.readUint32()
+			hunks := make([]Hunk, hunkCount)
+			for k := range hunks {
+				hunks[k] = Hunk{
+					OldStart:  int(dec.readInt32()),
+					OldLength: int(dec.readInt32()),
+					NewStart:  int(dec.readInt32()),
+					NewLength: int(dec.readInt32()),
+				}
+			}
+			diffs[j] = Diff{
+				Commit:         commit,
+				Path:           path,
+				ChecksumBefore: checksumBefore,
+				ChecksumAfter:  checksumAfter,
+				Hunks:          hunks,
+				RenamedFrom:    renamedFrom,
+				Parent:         parent,
+			}
+			if commit != nil {
+				commit.Diffs = append(commit.Diffs, &diffs[j])
+			}
+		}
+		history.Files[path] = diffs
+	}
+
+	if dec.err != nil && dec.err != io.EOF {
+		return nil, dec.err
+	}
+	return history, nil
+}
+
+// UpdateHistory brings h up to date with repo by replaying only the
+// commits made since the last one h already knows about (using the
+// last entry of h.Hashes as the boundary) and merging them in place.
+// This is far cheaper than re-parsing a repository's entire history on
+// every restart.
+//
+// UpdateHistory does not fix up renames whose "from" side falls
+// outside the new commit range: the rename's Diff still records
+// RenamedFrom, so (*GitHistory).Followed finds the old path, but the
+// old path's diffs are not copied into h.Files for the new path, so
+// Blame on the new path does not see them.
+// opts should match whatever RunGitLogOpts was used to build h in the
+// first place, so the incremental update is parsed consistently with
+// the rest of h.
+func UpdateHistory(ctx context.Context, h *GitHistory, repo string, opts RunGitLogOpts) error {
+	if len(h.Hashes) == 0 {
+		return fmt.Errorf("blameworthy: UpdateHistory requires a non-empty history; use ParseGitLog for a fresh one")
+	}
+	lastHash := h.Hashes[len(h.Hashes)-1]
+
+	stdout, err := RunGitLog(ctx, repo, lastHash+"..HEAD", opts)
+	if err != nil {
+		return err
+	}
+	addition, err := ParseGitLog(stdout)
+	if err != nil {
+		return err
+	}
+
+	h.Hashes = append(h.Hashes, addition.Hashes...)
+	for hash, commit := range addition.Commits {
+		h.Commits[hash] = commit
+	}
+	for path, diffs := range addition.Files {
+		h.Files[path] = append(h.Files[path], diffs...)
+	}
+
+	// hashPos and blameCache were built against the old h.Hashes;
+	// drop them so the next Blame call rebuilds against the commits
+	// just merged in instead of treating them as unknown.
+	h.blameMu.Lock()
+	h.hashPos = nil
+	h.blameCache = nil
+	h.blameMu.Unlock()
+
+	return nil
+}
+
+// historyEncoder writes the primitives SaveHistory needs, sticking the
+// first error it hits so call sites don't need to check one after
+// every write.
+type historyEncoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *historyEncoder) writeUint32(v uint32) {
+	if e.err != nil {
+		return
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	_, e.err = e.w.Write(buf[:])
+}
+
+func (e *historyEncoder) writeInt32(v int32) {
+	e.writeUint32(uint32(v))
+}
+
+// writeBytes is for hashes only: those are at most 32 bytes (a full
+// SHA-256 blob hash; truncated commit hashes are shorter, and an empty
+// hash is 0 bytes), so a 1-byte length prefix fits comfortably.
+func (e *historyEncoder) writeBytes(b []byte) {
+	if e.err != nil {
+		return
+	}
+	if len(b) > 0xff {
+		e.err = fmt.Errorf("blameworthy: %d-byte value too long to encode", len(b))
+		return
+	}
+	if e.err = e.w.WriteByte(byte(len(b))); e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+// writeString is for paths and author strings, which unlike hashes
+// have no fixed upper bound (a generated or vendored tree routinely
+// has paths past 255 bytes), so its length prefix is a uvarint rather
+// than a single byte.
+func (e *historyEncoder) writeString(s string) {
+	if e.err != nil {
+		return
+	}
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(s)))
+	if _, e.err = e.w.Write(lenBuf[:n]); e.err != nil {
+		return
+	}
+	_, e.err = e.w.WriteString(s)
+}
+
+// writeHash encodes a hex hash (commit or blob) as its raw bytes
+// instead of as hex text, halving its size on disk.
+func (e *historyEncoder) writeHash(hash string) {
+	if e.err != nil {
+		return
+	}
+	raw, err := hex.DecodeString(hash)
+	if err != nil {
+		e.err = fmt.Errorf("blameworthy: bad hash %q: %w", hash, err)
+		return
+	}
+	e.writeBytes(raw)
+}
+
+// historyDecoder is the read-side counterpart of historyEncoder.
+type historyDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *historyDecoder) readUint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	var buf [4]byte
+	if _, d.err = io.ReadFull(d.r, buf[:]); d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+func (d *historyDecoder) readInt32() int32 {
+	return int32(d.readUint32())
+}
+
+// readBytes is the counterpart of writeBytes: a hash with a 1-byte
+// length prefix.
+func (d *historyDecoder) readBytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	n, err := d.r.ReadByte()
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, d.err = io.ReadFull(d.r, buf); d.err != nil {
+		return nil
+	}
+	return buf
+}
+
+// readString is the counterpart of writeString: a path or author
+// string with a uvarint length prefix.
+func (d *historyDecoder) readString() string {
+	if d.err != nil {
+		return ""
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.err = err
+		return ""
+	}
+	if n == 0 {
+		return ""
+	}
+	buf := make([]byte, n)
+	if _, d.err = io.ReadFull(d.r, buf); d.err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+func (d *historyDecoder) readHash() string {
+	b := d.readBytes()
+	if b == nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}